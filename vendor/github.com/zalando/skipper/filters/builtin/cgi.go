@@ -0,0 +1,248 @@
+// Copyright 2015 Zalando SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builtin
+
+import (
+	"bufio"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/zalando/skipper/filters"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+const CGIName = "cgi"
+
+type cgi struct {
+	webRoot, script string
+}
+
+// cgiHeader is the parsed form of the CGI response header block: the
+// lines a script writes to stdout before the blank line that
+// terminates it.
+type cgiHeader struct {
+	status int
+	header http.Header
+}
+
+// Reads the CGI response header block from r: a "Name: value" line
+// per header, optionally a "Status:" line setting the response status
+// (defaulting to 200, or to 302 when only a "Location:" header is
+// present), terminated by a blank line, per RFC 3875.
+func parseCGIHeader(r *bufio.Reader) (cgiHeader, error) {
+	header := http.Header{}
+	status := http.StatusOK
+	sawStatus := false
+	sawLocation := false
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil && line == "" {
+			return cgiHeader{}, err
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		name := strings.TrimSpace(parts[0])
+		value := strings.TrimSpace(parts[1])
+
+		switch strings.ToLower(name) {
+		case "status":
+			sawStatus = true
+			if fields := strings.Fields(value); len(fields) > 0 {
+				if code, err := strconv.Atoi(fields[0]); err == nil {
+					status = code
+				}
+			}
+		case "location":
+			sawLocation = true
+			header.Set(name, value)
+		default:
+			header.Add(name, value)
+		}
+	}
+
+	if sawLocation && !sawStatus {
+		status = http.StatusFound
+	}
+
+	return cgiHeader{status: status, header: header}, nil
+}
+
+// Wraps a running CGI script's stdout, making sure the process is
+// reaped and its exit status observed when the response body is
+// closed.
+type cgiBody struct {
+	r   *bufio.Reader
+	cmd *exec.Cmd
+}
+
+func (b *cgiBody) Read(p []byte) (int, error) { return b.r.Read(p) }
+
+func (b *cgiBody) Close() error {
+	return b.cmd.Wait()
+}
+
+func hostPort(addr string) (host, port string) {
+	if h, p, err := net.SplitHostPort(addr); err == nil {
+		return h, p
+	}
+
+	return addr, ""
+}
+
+// Builds the CGI/1.1 environment for req, per RFC 3875: the
+// GATEWAY_INTERFACE, REQUEST_METHOD, QUERY_STRING, PATH_INFO,
+// SCRIPT_NAME, CONTENT_LENGTH, CONTENT_TYPE and REMOTE_ADDR
+// variables, plus an HTTP_* variable for every other request header.
+func cgiEnv(req *http.Request, script, pathInfo string) []string {
+	remoteHost, _ := hostPort(req.RemoteAddr)
+	serverHost, serverPort := hostPort(req.Host)
+
+	env := append(os.Environ(),
+		"GATEWAY_INTERFACE=CGI/1.1",
+		"SERVER_PROTOCOL=HTTP/1.1",
+		"SERVER_SOFTWARE=skipper",
+		"REQUEST_METHOD="+req.Method,
+		"SCRIPT_NAME="+script,
+		"PATH_INFO="+pathInfo,
+		"QUERY_STRING="+req.URL.RawQuery,
+		"REMOTE_ADDR="+remoteHost,
+		"SERVER_NAME="+serverHost,
+		"SERVER_PORT="+serverPort)
+
+	if cl := req.Header.Get("Content-Length"); cl != "" {
+		env = append(env, "CONTENT_LENGTH="+cl)
+	}
+
+	if ct := req.Header.Get("Content-Type"); ct != "" {
+		env = append(env, "CONTENT_TYPE="+ct)
+	}
+
+	for name, values := range req.Header {
+		switch name {
+		case "Content-Length", "Content-Type":
+			continue
+		}
+
+		key := "HTTP_" + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+		env = append(env, key+"="+strings.Join(values, ", "))
+	}
+
+	return env
+}
+
+// Starts script as a CGI/1.1 process for req, piping req.Body to its
+// stdin, and returns a response whose body streams the script's stdout
+// once the CGI header block has been parsed off the front of it.
+func runCGI(req *http.Request, script, pathInfo string) (*http.Response, error) {
+	cmd := exec.Command(script)
+	cmd.Env = cgiEnv(req, script, pathInfo)
+	cmd.Stdin = req.Body
+	cmd.Stderr = os.Stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(stdout)
+	header, err := parseCGIHeader(r)
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, err
+	}
+
+	return &http.Response{
+		StatusCode: header.status,
+		Header:     header.header,
+		Body:       &cgiBody{r: r, cmd: cmd},
+	}, nil
+}
+
+// Returns a filter Spec that executes an external script per RFC 3875
+// for every matching request, and streams its stdout back as the
+// response. It shunts the route.
+//
+// Filter instances of this specification expect two parameters: a
+// request path prefix and the path to the script to execute. As with
+// the static filter, the prefix is clipped from the request path
+// before the remainder is exposed to the script as PATH_INFO.
+//
+// Name: "cgi".
+func NewCGI() filters.Spec { return &cgi{} }
+
+// "cgi"
+func (spec *cgi) Name() string { return CGIName }
+
+// Creates instances of the cgi filter. Expects two parameters: request
+// path prefix and path to the script to run.
+func (spec *cgi) CreateFilter(config []interface{}) (filters.Filter, error) {
+	if len(config) != 2 {
+		return nil, fmt.Errorf("invalid number of args: %d, expected 2", len(config))
+	}
+
+	webRoot, ok := config[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid parameter type, expected string for web root prefix")
+	}
+
+	script, ok := config[1].(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid parameter type, expected string for script path")
+	}
+
+	return &cgi{webRoot, script}, nil
+}
+
+// Runs the script and marks the request served.
+func (f *cgi) Request(ctx filters.FilterContext) {
+	req := ctx.Request()
+	p := req.URL.Path
+
+	if len(p) < len(f.webRoot) {
+		ctx.Serve(&http.Response{StatusCode: http.StatusNotFound})
+		return
+	}
+
+	rsp, err := runCGI(req, f.script, p[len(f.webRoot):])
+	if err != nil {
+		log.Error(err)
+		ctx.Serve(&http.Response{StatusCode: http.StatusInternalServerError})
+		return
+	}
+
+	ctx.Serve(rsp)
+}
+
+// Noop.
+func (f *cgi) Response(filters.FilterContext) {}
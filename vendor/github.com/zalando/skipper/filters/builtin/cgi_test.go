@@ -0,0 +1,62 @@
+// Copyright 2015 Zalando SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builtin
+
+import (
+	"bufio"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestParseCGIHeader(t *testing.T) {
+	for _, ti := range []struct {
+		msg        string
+		block      string
+		wantStatus int
+	}{{
+		"defaults to 200 with no headers",
+		"\r\n",
+		http.StatusOK,
+	}, {
+		"parses a numeric status",
+		"Status: 404 Not Found\r\n\r\n",
+		http.StatusNotFound,
+	}, {
+		"falls back to 200 on an empty status value instead of panicking",
+		"Status: \r\n\r\n",
+		http.StatusOK,
+	}, {
+		"falls back to 200 on a non-numeric status value",
+		"Status: banana\r\n\r\n",
+		http.StatusOK,
+	}, {
+		"defaults to 302 when only Location is set",
+		"Location: /elsewhere\r\n\r\n",
+		http.StatusFound,
+	}} {
+		t.Run(ti.msg, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(ti.block))
+			header, err := parseCGIHeader(r)
+			if err != nil {
+				t.Fatalf("parseCGIHeader failed: %v", err)
+			}
+
+			if header.status != ti.wantStatus {
+				t.Errorf("got status %d, want %d", header.status, ti.wantStatus)
+			}
+		})
+	}
+}
@@ -0,0 +1,505 @@
+// Copyright 2015 Zalando SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builtin
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/zalando/skipper/filters"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const FastCGIName = "fastcgi"
+
+// FastCGI record types and the Responder role, as defined by the
+// FastCGI specification.
+const (
+	fcgiVersion1 = 1
+
+	fcgiBeginRequest = 1
+	fcgiEndRequest   = 3
+	fcgiParams       = 4
+	fcgiStdin        = 5
+	fcgiStdout       = 6
+	fcgiStderr       = 7
+
+	fcgiResponder = 1
+	fcgiKeepConn  = 1
+
+	// The request id used on every connection. Connections in the pool
+	// are never shared between concurrent requests (see fcgiPool), so
+	// there is never more than one request in flight on a given
+	// connection needing to be told apart from another.
+	fcgiRequestID = 1
+
+	fcgiMaxContentLength = 65535
+)
+
+// Connections per backend address kept open for reuse, and the upper
+// bound on how many requests to the same backend can be in flight at
+// once. Responders like PHP-FPM commonly advertise FCGI_MPXS_CONNS=0,
+// i.e. they don't support multiplexing several requests over one
+// connection, so concurrency has to come from the number of
+// connections instead.
+const fcgiPoolSize = 8
+
+type fastcgi struct {
+	webRoot, network, address string
+}
+
+// Returns a filter Spec that proxies matching requests to a FastCGI
+// Responder (e.g. PHP-FPM) speaking the Responder role over a Unix or
+// TCP socket, and streams the backend's stdout back as the response
+// body. It shunts the route. Requests against the same backend address
+// share a bounded pool of persistent connections, one request in
+// flight per connection at a time, the way a real FastCGI client talks
+// to a php-fpm pool, rather than dialing a fresh connection per
+// request or multiplexing requests over a single shared one.
+//
+// Filter instances of this specification expect two parameters: a
+// request path prefix and the FastCGI backend address. An address
+// starting with "/" is dialed over a Unix domain socket, anything else
+// over TCP.
+//
+// Name: "fastcgi".
+func NewFastCGI() filters.Spec { return &fastcgi{} }
+
+// "fastcgi"
+func (spec *fastcgi) Name() string { return FastCGIName }
+
+// Creates instances of the fastcgi filter. Expects two parameters:
+// request path prefix and FastCGI backend address.
+func (spec *fastcgi) CreateFilter(config []interface{}) (filters.Filter, error) {
+	if len(config) != 2 {
+		return nil, fmt.Errorf("invalid number of args: %d, expected 2", len(config))
+	}
+
+	webRoot, ok := config[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid parameter type, expected string for web root prefix")
+	}
+
+	address, ok := config[1].(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid parameter type, expected string for fastcgi address")
+	}
+
+	network := "tcp"
+	if strings.HasPrefix(address, "/") {
+		network = "unix"
+	}
+
+	return &fastcgi{webRoot, network, address}, nil
+}
+
+// Proxies the request to the FastCGI backend and marks the request
+// served.
+func (f *fastcgi) Request(ctx filters.FilterContext) {
+	req := ctx.Request()
+	p := req.URL.Path
+
+	if len(p) < len(f.webRoot) {
+		ctx.Serve(&http.Response{StatusCode: http.StatusNotFound})
+		return
+	}
+
+	rsp, err := callFastCGI(f.network, f.address, req, p[len(f.webRoot):])
+	if err != nil {
+		log.Error(err)
+		ctx.Serve(&http.Response{StatusCode: http.StatusBadGateway})
+		return
+	}
+
+	ctx.Serve(rsp)
+}
+
+// Noop.
+func (f *fastcgi) Response(filters.FilterContext) {}
+
+type fcgiHeader struct {
+	Version       uint8
+	Type          uint8
+	RequestIDB1   uint8
+	RequestIDB0   uint8
+	ContentLenB1  uint8
+	ContentLenB0  uint8
+	PaddingLength uint8
+	Reserved      uint8
+}
+
+// Writes content to w as one or more FastCGI records of the given
+// type, under fcgiRequestID, splitting it into records no larger than
+// fcgiMaxContentLength. Padding is always left at zero: the FastCGI
+// spec only recommends it for alignment, it is never required for
+// correctness.
+func fcgiWriteRecord(w io.Writer, typ uint8, content []byte) error {
+	for {
+		chunk := content
+		if len(chunk) > fcgiMaxContentLength {
+			chunk = chunk[:fcgiMaxContentLength]
+		}
+		content = content[len(chunk):]
+
+		h := fcgiHeader{
+			Version:      fcgiVersion1,
+			Type:         typ,
+			RequestIDB1:  byte(fcgiRequestID >> 8),
+			RequestIDB0:  byte(fcgiRequestID),
+			ContentLenB1: byte(len(chunk) >> 8),
+			ContentLenB0: byte(len(chunk)),
+		}
+
+		if err := binary.Write(w, binary.BigEndian, h); err != nil {
+			return err
+		}
+
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+
+		if len(content) == 0 {
+			return nil
+		}
+	}
+}
+
+// Encodes a FastCGI name-value pair, using the spec's 4-byte length
+// form whenever a name or value is 128 bytes or longer.
+func fcgiWriteNameValue(buf *bytes.Buffer, name, value string) {
+	writeLen := func(n int) {
+		if n < 128 {
+			buf.WriteByte(byte(n))
+			return
+		}
+
+		var l [4]byte
+		binary.BigEndian.PutUint32(l[:], uint32(n)|1<<31)
+		buf.Write(l[:])
+	}
+
+	writeLen(len(name))
+	writeLen(len(value))
+	buf.WriteString(name)
+	buf.WriteString(value)
+}
+
+// Begins a Responder request, asking the backend to keep the
+// connection open afterwards (FCGI_KEEP_CONN) so it can be returned to
+// the pool and reused for a later request instead of being dialed
+// again from scratch.
+func fcgiWriteBeginRequest(w io.Writer) error {
+	body := []byte{0, fcgiResponder, fcgiKeepConn, 0, 0, 0, 0, 0}
+	return fcgiWriteRecord(w, fcgiBeginRequest, body)
+}
+
+func fcgiWriteParams(w io.Writer, params []string) error {
+	var buf bytes.Buffer
+	for i := 0; i+1 < len(params); i += 2 {
+		fcgiWriteNameValue(&buf, params[i], params[i+1])
+	}
+
+	if err := fcgiWriteRecord(w, fcgiParams, buf.Bytes()); err != nil {
+		return err
+	}
+
+	return fcgiWriteRecord(w, fcgiParams, nil)
+}
+
+func fcgiWriteStdin(w io.Writer, body io.Reader) error {
+	buf := make([]byte, fcgiMaxContentLength)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if werr := fcgiWriteRecord(w, fcgiStdin, buf[:n]); werr != nil {
+				return werr
+			}
+		}
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return fcgiWriteRecord(w, fcgiStdin, nil)
+}
+
+// Builds the FastCGI PARAMS for req, the same variables cgiEnv sets
+// for a plain CGI script, as a flat name, value, name, value, ... slice.
+// Unlike a local CGI script, the backend resolves its own script from
+// SCRIPT_NAME, so the full, unclipped request path is passed there,
+// while PATH_INFO keeps the part left after clipping the webRoot
+// prefix.
+func fastCGIParams(req *http.Request, pathInfo string) []string {
+	remoteHost, _ := hostPort(req.RemoteAddr)
+	serverHost, serverPort := hostPort(req.Host)
+
+	params := []string{
+		"GATEWAY_INTERFACE", "CGI/1.1",
+		"SERVER_PROTOCOL", "HTTP/1.1",
+		"SERVER_SOFTWARE", "skipper",
+		"REQUEST_METHOD", req.Method,
+		"SCRIPT_NAME", req.URL.Path,
+		"PATH_INFO", pathInfo,
+		"QUERY_STRING", req.URL.RawQuery,
+		"REMOTE_ADDR", remoteHost,
+		"SERVER_NAME", serverHost,
+		"SERVER_PORT", serverPort,
+	}
+
+	if cl := req.Header.Get("Content-Length"); cl != "" {
+		params = append(params, "CONTENT_LENGTH", cl)
+	}
+
+	if ct := req.Header.Get("Content-Type"); ct != "" {
+		params = append(params, "CONTENT_TYPE", ct)
+	}
+
+	for name, values := range req.Header {
+		switch name {
+		case "Content-Length", "Content-Type":
+			continue
+		}
+
+		key := "HTTP_" + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+		params = append(params, key, strings.Join(values, ", "))
+	}
+
+	return params
+}
+
+// Reads FastCGI STDOUT/STDERR/END_REQUEST records from conn until
+// END_REQUEST, streaming STDOUT to pw as it arrives (so the caller can
+// start consuming the response before the backend has finished
+// writing all of it) and buffering STDERR for logging. Runs
+// concurrently with the request being written to the same connection,
+// since the backend may start responding before the request body has
+// been fully sent. Returns nil after a clean END_REQUEST, the read
+// error otherwise; pw is always closed one way or the other.
+func fcgiReadResponse(conn net.Conn, pw *io.PipeWriter, stderr *bytes.Buffer) error {
+	for {
+		var h fcgiHeader
+		if err := binary.Read(conn, binary.BigEndian, &h); err != nil {
+			pw.CloseWithError(err)
+			return err
+		}
+
+		contentLength := int(h.ContentLenB1)<<8 | int(h.ContentLenB0)
+		content := make([]byte, contentLength)
+		if _, err := io.ReadFull(conn, content); err != nil {
+			pw.CloseWithError(err)
+			return err
+		}
+
+		if h.PaddingLength > 0 {
+			if _, err := io.CopyN(ioutil.Discard, conn, int64(h.PaddingLength)); err != nil {
+				pw.CloseWithError(err)
+				return err
+			}
+		}
+
+		switch h.Type {
+		case fcgiStdout:
+			if len(content) > 0 {
+				if _, err := pw.Write(content); err != nil {
+					return err
+				}
+			}
+		case fcgiStderr:
+			stderr.Write(content)
+		case fcgiEndRequest:
+			pw.Close()
+			return nil
+		}
+	}
+}
+
+// Writes one Responder request to conn and returns a reader streaming
+// its response body, without holding any lock for the duration: conn
+// is checked out of the pool for the exclusive use of this request (see
+// fcgiPool), so there's no other writer it could block.
+func fcgiRoundTrip(conn net.Conn, params []string, body io.Reader) (*bufio.Reader, <-chan error, error) {
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	var stderr bytes.Buffer
+
+	go func() {
+		err := fcgiReadResponse(conn, pw, &stderr)
+		if stderr.Len() > 0 {
+			log.Error(stderr.String())
+		}
+		done <- err
+	}()
+
+	if err := fcgiWriteBeginRequest(conn); err != nil {
+		pw.CloseWithError(err)
+		return nil, nil, err
+	}
+
+	if err := fcgiWriteParams(conn, params); err != nil {
+		pw.CloseWithError(err)
+		return nil, nil, err
+	}
+
+	if err := fcgiWriteStdin(conn, body); err != nil {
+		pw.CloseWithError(err)
+		return nil, nil, err
+	}
+
+	return bufio.NewReader(pr), done, nil
+}
+
+// A bounded pool of persistent connections per backend address. Unlike
+// a connection multiplexed between concurrent requests via distinct
+// FastCGI request ids, each connection here is only ever checked out
+// to one request at a time, matching how FCGI_MPXS_CONNS=0 responders
+// such as PHP-FPM actually behave. get blocks once fcgiPoolSize
+// connections to a backend are already checked out, the same
+// backpressure a real pooled client would apply.
+type fcgiPool struct {
+	size int
+
+	mu   sync.Mutex
+	sem  map[string]chan struct{}
+	idle map[string][]net.Conn
+}
+
+func newFCGIPool(size int) *fcgiPool {
+	return &fcgiPool{size: size, sem: make(map[string]chan struct{}), idle: make(map[string][]net.Conn)}
+}
+
+var globalFCGIPool = newFCGIPool(fcgiPoolSize)
+
+func (p *fcgiPool) semaphore(key string) chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	sem, ok := p.sem[key]
+	if !ok {
+		sem = make(chan struct{}, p.size)
+		for i := 0; i < p.size; i++ {
+			sem <- struct{}{}
+		}
+		p.sem[key] = sem
+	}
+
+	return sem
+}
+
+// Checks out a connection for the exclusive use of one request,
+// blocking until fewer than size connections to this backend are
+// already checked out. Reuses an idle, kept-alive connection when one
+// is available, otherwise dials a new one.
+func (p *fcgiPool) get(network, address string) (net.Conn, error) {
+	key := network + " " + address
+	<-p.semaphore(key)
+
+	p.mu.Lock()
+	idle := p.idle[key]
+	var conn net.Conn
+	if n := len(idle); n > 0 {
+		conn = idle[n-1]
+		p.idle[key] = idle[:n-1]
+	}
+	p.mu.Unlock()
+
+	if conn != nil {
+		return conn, nil
+	}
+
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		p.semaphore(key) <- struct{}{}
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// Returns a checked-out connection: to the idle set for reuse when
+// healthy, closed otherwise. Either way, releases its slot in the
+// backend's concurrency limit.
+func (p *fcgiPool) put(network, address string, conn net.Conn, healthy bool) {
+	key := network + " " + address
+
+	if healthy {
+		p.mu.Lock()
+		p.idle[key] = append(p.idle[key], conn)
+		p.mu.Unlock()
+	} else {
+		conn.Close()
+	}
+
+	p.semaphore(key) <- struct{}{}
+}
+
+// Wraps the streamed body of a pooled FastCGI response. Closing it
+// waits for the backend to finish the response (the same way cgiBody
+// waits for the CGI process to exit), then returns the connection to
+// the pool, or closes it if the response didn't end cleanly.
+type fcgiBody struct {
+	r                *bufio.Reader
+	done             <-chan error
+	network, address string
+	conn             net.Conn
+}
+
+func (b *fcgiBody) Read(p []byte) (int, error) { return b.r.Read(p) }
+
+func (b *fcgiBody) Close() error {
+	err := <-b.done
+	globalFCGIPool.put(b.network, b.address, b.conn, err == nil)
+	return err
+}
+
+// Checks out a pooled connection for network/address, runs req through
+// it as a FastCGI Responder request, and returns a response whose body
+// streams the backend's stdout as it arrives.
+func callFastCGI(network, address string, req *http.Request, pathInfo string) (*http.Response, error) {
+	conn, err := globalFCGIPool.get(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	r, done, err := fcgiRoundTrip(conn, fastCGIParams(req, pathInfo), req.Body)
+	if err != nil {
+		globalFCGIPool.put(network, address, conn, false)
+		return nil, err
+	}
+
+	header, err := parseCGIHeader(r)
+	if err != nil {
+		<-done
+		globalFCGIPool.put(network, address, conn, false)
+		return nil, err
+	}
+
+	return &http.Response{
+		StatusCode: header.status,
+		Header:     header.header,
+		Body:       &fcgiBody{r: r, done: done, network: network, address: address, conn: conn},
+	}, nil
+}
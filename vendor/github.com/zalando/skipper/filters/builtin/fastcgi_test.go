@@ -0,0 +1,236 @@
+// Copyright 2015 Zalando SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builtin
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFCGIWriteRecordRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	content := []byte("REQUEST_METHOD")
+	if err := fcgiWriteRecord(&buf, fcgiStdin, content); err != nil {
+		t.Fatalf("fcgiWriteRecord failed: %v", err)
+	}
+
+	var h fcgiHeader
+	if err := binary.Read(&buf, binary.BigEndian, &h); err != nil {
+		t.Fatalf("failed to read back header: %v", err)
+	}
+
+	if h.Type != fcgiStdin {
+		t.Errorf("got type %d, want %d", h.Type, fcgiStdin)
+	}
+
+	gotID := uint16(h.RequestIDB1)<<8 | uint16(h.RequestIDB0)
+	if gotID != fcgiRequestID {
+		t.Errorf("got request id %d, want %d", gotID, fcgiRequestID)
+	}
+
+	gotLen := int(h.ContentLenB1)<<8 | int(h.ContentLenB0)
+	if gotLen != len(content) {
+		t.Errorf("got content length %d, want %d", gotLen, len(content))
+	}
+
+	if got := buf.Next(gotLen); !bytes.Equal(got, content) {
+		t.Errorf("got content %q, want %q", got, content)
+	}
+}
+
+func TestFastCGIParams(t *testing.T) {
+	req := &http.Request{
+		Method:     "GET",
+		URL:        &url.URL{Path: "/app/index.php", RawQuery: "a=1"},
+		Proto:      "HTTP/1.1",
+		Host:       "example.com:8080",
+		Header:     http.Header{"X-Test": []string{"value"}},
+		RemoteAddr: "10.0.0.1:1234",
+	}
+
+	params := fastCGIParams(req, "/index.php")
+
+	m := map[string]string{}
+	for i := 0; i+1 < len(params); i += 2 {
+		m[params[i]] = params[i+1]
+	}
+
+	for name, want := range map[string]string{
+		"SCRIPT_NAME":    "/app/index.php",
+		"PATH_INFO":      "/index.php",
+		"QUERY_STRING":   "a=1",
+		"REQUEST_METHOD": "GET",
+		"HTTP_X_TEST":    "value",
+	} {
+		if got := m[name]; got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+}
+
+// Minimal server-side FastCGI record read/write, used to fake a
+// Responder in the pool test below. Independent of the client-side
+// fcgiWriteRecord/fcgiReadResponse so the test also catches wire
+// format regressions rather than just mirroring production code.
+func readFCGITestRecord(r io.Reader) (typ uint8, content []byte, err error) {
+	var h fcgiHeader
+	if err := binary.Read(r, binary.BigEndian, &h); err != nil {
+		return 0, nil, err
+	}
+
+	n := int(h.ContentLenB1)<<8 | int(h.ContentLenB0)
+	content = make([]byte, n)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return 0, nil, err
+	}
+
+	if h.PaddingLength > 0 {
+		if _, err := io.CopyN(ioutil.Discard, r, int64(h.PaddingLength)); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	return h.Type, content, nil
+}
+
+func writeFCGITestRecord(w io.Writer, typ uint8, content []byte) error {
+	h := fcgiHeader{
+		Version:      fcgiVersion1,
+		Type:         typ,
+		RequestIDB1:  byte(fcgiRequestID >> 8),
+		RequestIDB0:  byte(fcgiRequestID),
+		ContentLenB1: byte(len(content) >> 8),
+		ContentLenB0: byte(len(content)),
+	}
+
+	if err := binary.Write(w, binary.BigEndian, h); err != nil {
+		return err
+	}
+
+	_, err := w.Write(content)
+	return err
+}
+
+// Fakes a FastCGI Responder that serves one request per connection at
+// a time, honoring FCGI_KEEP_CONN by looping to serve further requests
+// on the same connection, and reports how many requests it has in
+// flight concurrently and how many distinct connections it accepted.
+func runFakeFCGIServer(ln net.Listener, activeNow, maxActive, totalConns *int64) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+
+		atomic.AddInt64(totalConns, 1)
+
+		go func(conn net.Conn) {
+			defer conn.Close()
+
+			for {
+				typ, _, err := readFCGITestRecord(conn)
+				if err != nil || typ != fcgiBeginRequest {
+					return
+				}
+
+				cur := atomic.AddInt64(activeNow, 1)
+				for {
+					prev := atomic.LoadInt64(maxActive)
+					if cur <= prev || atomic.CompareAndSwapInt64(maxActive, prev, cur) {
+						break
+					}
+				}
+
+				for {
+					typ, content, err := readFCGITestRecord(conn)
+					if err != nil || typ != fcgiParams {
+						return
+					}
+					if len(content) == 0 {
+						break
+					}
+				}
+
+				for {
+					typ, content, err := readFCGITestRecord(conn)
+					if err != nil || typ != fcgiStdin {
+						return
+					}
+					if len(content) == 0 {
+						break
+					}
+				}
+
+				// Widen the window in which concurrent requests overlap.
+				time.Sleep(5 * time.Millisecond)
+
+				writeFCGITestRecord(conn, fcgiStdout, []byte("Status: 200 OK\r\n\r\nok"))
+				writeFCGITestRecord(conn, fcgiEndRequest, make([]byte, 8))
+
+				atomic.AddInt64(activeNow, -1)
+			}
+		}(conn)
+	}
+}
+
+func TestFastCGIPoolBoundsConcurrencyAndReusesConnections(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	var activeNow, maxActive, totalConns int64
+	go runFakeFCGIServer(ln, &activeNow, &maxActive, &totalConns)
+
+	const requests = 3 * fcgiPoolSize
+
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			req := httptest.NewRequest("GET", "/app/index.php", nil)
+			rsp, err := callFastCGI("tcp", ln.Addr().String(), req, "/index.php")
+			if err != nil {
+				t.Errorf("callFastCGI failed: %v", err)
+				return
+			}
+
+			io.Copy(ioutil.Discard, rsp.Body)
+			rsp.Body.Close()
+		}()
+	}
+	wg.Wait()
+
+	if got := atomic.LoadInt64(&maxActive); got > fcgiPoolSize {
+		t.Errorf("got %d concurrent in-flight requests to one backend, want at most the pool size %d", got, fcgiPoolSize)
+	}
+
+	if got := atomic.LoadInt64(&totalConns); got > fcgiPoolSize {
+		t.Errorf("got %d connections opened for %d requests, want at most the pool size %d (connections should be reused via FCGI_KEEP_CONN)", got, requests, fcgiPoolSize)
+	}
+}
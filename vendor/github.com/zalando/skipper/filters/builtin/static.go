@@ -15,34 +15,80 @@
 package builtin
 
 import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/zalando/skipper/filters"
+	"hash"
 	"io"
+	"mime"
 	"net/http"
+	"os"
 	"path"
 	"strconv"
+	"strings"
 )
 
+const (
+	StaticName    = "static"
+	StaticSPAName = "staticSPA"
+)
+
+// Extensions eligible for precompressed serving when none are given
+// explicitly as a filter argument.
+var defaultCompressExtensions = []string{".html", ".css", ".js", ".json", ".svg", ".txt", ".xml"}
+
+// The precompressed encodings recognized in Accept-Encoding, in the
+// order they are preferred.
+var compressEncodings = []struct{ suffix, token string }{
+	{".br", "br"},
+	{".gz", "gzip"},
+}
+
 type delayedBody struct {
-	request       *http.Request
-	path          string
-	response      *http.Response
-	reader        io.ReadCloser
-	writer        *io.PipeWriter
-	contentLength int
-	written       int
-	headerDone    chan struct{}
+	request         *http.Request
+	path            string
+	response        *http.Response
+	reader          io.ReadCloser
+	writer          *io.PipeWriter
+	contentLength   int
+	compressedSize  int
+	contentType     string
+	contentEncoding string
+	written         int
+	headerDone      chan struct{}
 }
 
 type static struct {
+	name          string
 	webRoot, root string
+	fs            http.FileSystem
+	compressExt   []string
+	etagMode      string
+	etagHash      string
+	spa           bool
+	fallback      string
 }
 
 // Creates a delayed Body/ResponseWriter pipe object, that
 // waits until WriteHeader of the ResponseWriter completes
-// but delays Write until the body read is started.
-func newDelayed(req *http.Request, p string) *http.Response {
+// but delays Write until the body read is started. When compressExt
+// allows it and the client advertises support for it in Accept-Encoding,
+// a precompressed ".br" or ".gz" sibling of p is served instead, with
+// the original file's Content-Type preserved. When etagMode is set, an
+// ETag for the served path is computed and set on the response header
+// before http.ServeFile runs, so it can serve conditional GETs (304)
+// and evaluate If-Range against it. When fallback is set and p does not
+// resolve to an existing file (or resolves to a directory with no
+// index.html of its own), fallback is served in its place with a 200,
+// for single-page apps that do client-side routing. The fallback is
+// only considered for paths that don't look like they name a static
+// asset (no file extension on the last path segment), so a typo'd or
+// missing asset path (e.g. "/app/logo.png") still gets a 404 instead
+// of being swallowed into a 200 text/html response.
+func newDelayed(req *http.Request, p string, compressExt []string, etagMode, etagHash, fallback string) *http.Response {
 	pr, pw := io.Pipe()
 	rsp := &http.Response{Header: make(http.Header)}
 	db := &delayedBody{
@@ -51,7 +97,214 @@ func newDelayed(req *http.Request, p string) *http.Response {
 		reader:     pr,
 		writer:     pw,
 		headerDone: make(chan struct{})}
-	go http.ServeFile(db, db.request, p)
+
+	if fallback != "" && !looksLikeAsset(p) && !resolvable(p) {
+		p = fallback
+	}
+
+	servePath := p
+	if cp, ct, size, ok := precompressedVariant(req, p, compressExt); ok {
+		servePath = cp
+		db.contentType = ct
+		db.contentEncoding = compressEncoding(cp)
+		db.compressedSize = size
+	}
+
+	if etagMode != "" {
+		if fi, err := os.Stat(servePath); err == nil {
+			if etag, err := computeETag(servePath, fi, etagMode, etagHash); err == nil && etag != "" {
+				rsp.Header.Set("Etag", etag)
+			} else if err != nil {
+				log.Error(err)
+			}
+		}
+	}
+
+	go http.ServeFile(db, db.request, servePath)
+	<-db.headerDone
+	rsp.Body = db
+	return rsp
+}
+
+// Looks for a <p>.br or <p>.gz sibling of p on disk, in the preference
+// order of compressEncodings, and returns it together with p's content
+// type and the sibling's size, when ext allows compressing p's
+// extension and the request's Accept-Encoding advertises support for
+// it. ext == nil disables precompressed serving.
+func precompressedVariant(req *http.Request, p string, ext []string) (compressedPath, contentType string, size int, ok bool) {
+	if ext == nil || !extensionAllowed(p, ext) {
+		return "", "", 0, false
+	}
+
+	acceptEncoding := req.Header.Get("Accept-Encoding")
+	for _, enc := range compressEncodings {
+		if !acceptsEncoding(acceptEncoding, enc.token) {
+			continue
+		}
+
+		fi, err := os.Stat(p + enc.suffix)
+		if err != nil || fi.IsDir() {
+			continue
+		}
+
+		return p + enc.suffix, mime.TypeByExtension(path.Ext(p)), int(fi.Size()), true
+	}
+
+	return "", "", 0, false
+}
+
+// Reports whether token (e.g. "gzip") is accepted by the
+// Accept-Encoding header value acceptEncoding: present among its
+// comma-separated directives, and not explicitly disabled with a zero
+// q-value (e.g. "gzip;q=0"), per RFC 7231 section 5.3.4.
+func acceptsEncoding(acceptEncoding, token string) bool {
+	for _, directive := range strings.Split(acceptEncoding, ",") {
+		parts := strings.Split(directive, ";")
+		name := strings.TrimSpace(parts[0])
+		if !strings.EqualFold(name, token) {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range parts[1:] {
+			qv := strings.TrimSpace(param)
+			if !strings.HasPrefix(qv, "q=") {
+				continue
+			}
+
+			if parsed, err := strconv.ParseFloat(strings.TrimPrefix(qv, "q="), 64); err == nil {
+				q = parsed
+			}
+		}
+
+		return q > 0
+	}
+
+	return false
+}
+
+func extensionAllowed(p string, ext []string) bool {
+	e := path.Ext(p)
+	for _, allowed := range ext {
+		if strings.EqualFold(allowed, e) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Reports whether p can be served as is: it exists, and if it's a
+// directory, it has its own index.html to fall back to.
+func resolvable(p string) bool {
+	fi, err := os.Stat(p)
+	if err != nil {
+		return false
+	}
+
+	if !fi.IsDir() {
+		return true
+	}
+
+	_, err = os.Stat(path.Join(p, "index.html"))
+	return err == nil
+}
+
+// Reports whether the last segment of p has a file extension, as a
+// static asset path normally would (e.g. "/app/logo.png"), as opposed
+// to an SPA client-side route (e.g. "/app/settings"). Used to keep the
+// SPA fallback from masking a missing asset as a 200.
+func looksLikeAsset(p string) bool {
+	return path.Ext(path.Base(p)) != ""
+}
+
+func compressEncoding(p string) string {
+	switch path.Ext(p) {
+	case ".br":
+		return "br"
+	case ".gz":
+		return "gzip"
+	default:
+		return ""
+	}
+}
+
+// Computes an ETag for the file at p. mode == "" disables ETags. A
+// "weak" etag is derived from fi's modification time and size, which
+// is cheap but changes whenever the file is touched without its
+// content changing. A "strong" etag hashes the file's content with
+// hashAlg ("sha256" when empty, or "md5"/"sha1").
+//
+// Once set on the delayedBody's header before http.ServeFile is
+// invoked, net/http's own conditional-request handling (If-None-Match,
+// If-Range, etc.) picks it up, because it reads any Etag the caller
+// already set on the ResponseWriter.
+func computeETag(p string, fi os.FileInfo, mode, hashAlg string) (string, error) {
+	switch mode {
+	case "":
+		return "", nil
+	case "weak":
+		return fmt.Sprintf(`W/"%x-%x"`, fi.ModTime().UnixNano(), fi.Size()), nil
+	case "strong":
+		sum, err := hashFile(p, hashAlg)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf(`"%x"`, sum), nil
+	default:
+		return "", fmt.Errorf("unknown etag mode: %s", mode)
+	}
+}
+
+func hashFile(p, alg string) ([]byte, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var h hash.Hash
+	switch alg {
+	case "", "sha256":
+		h = sha256.New()
+	case "md5":
+		h = md5.New()
+	case "sha1":
+		h = sha1.New()
+	default:
+		return nil, fmt.Errorf("unknown etag hash: %s", alg)
+	}
+
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
+
+// Like newDelayed, but serves the request through http.FileServer against
+// an arbitrary http.FileSystem instead of calling http.ServeFile on a path
+// joined from an OS directory. The request is shallow-copied and its URL
+// path rewritten to p, the part of the original path left after clipping
+// the webRoot prefix, because http.FileServer resolves paths relative to
+// the root of the file system it was given.
+func newDelayedFS(req *http.Request, fs http.FileSystem, p string) *http.Response {
+	pr, pw := io.Pipe()
+	rsp := &http.Response{Header: make(http.Header)}
+
+	fsURL := *req.URL
+	fsURL.Path = p
+	fsReq := *req
+	fsReq.URL = &fsURL
+
+	db := &delayedBody{
+		request:    &fsReq,
+		response:   rsp,
+		reader:     pr,
+		writer:     pw,
+		headerDone: make(chan struct{})}
+
+	go http.FileServer(fs).ServeHTTP(db, db.request)
 	<-db.headerDone
 	rsp.Body = db
 	return rsp
@@ -63,7 +316,17 @@ func (b *delayedBody) Header() http.Header           { return b.response.Header
 // Implements http.ResponseWriter.Write. When Content-Length is set,
 // it signals EOF for the Body reader.
 func (b *delayedBody) Write(data []byte) (int, error) {
-	if b.request.Method == "HEAD" || b.response.StatusCode >= http.StatusMultipleChoices {
+	status := b.response.StatusCode
+
+	// No body for HEAD or a body-less redirect (e.g. 304). Other error
+	// responses get no body from here either, since WriteHeader already
+	// wrote their status text and closed the pipe, except 416, which
+	// WriteHeader lets through like a normal response because
+	// http.ServeFile's Content-Range: bytes */<size> header is only
+	// meaningful together with the short message body that goes with it.
+	if b.request.Method == "HEAD" ||
+		(status >= http.StatusMultipleChoices && status < http.StatusBadRequest) ||
+		(status >= http.StatusBadRequest && status != http.StatusRequestedRangeNotSatisfiable) {
 		return 0, nil
 	}
 
@@ -92,7 +355,11 @@ func (b *delayedBody) Write(data []byte) (int, error) {
 func (b *delayedBody) WriteHeader(status int) {
 	b.response.StatusCode = status
 
-	// No content on HEAD or redirect (e.g. 304, not modified).
+	// No content on HEAD or redirect (e.g. 304, not modified). Leave the
+	// headers alone here: net/http's writeNotModified has already
+	// deliberately stripped Content-Type and Content-Encoding from a 304,
+	// per RFC 7232 section 4.1, and the override below must not put them
+	// back.
 	if b.request.Method == "HEAD" ||
 		status >= http.StatusMultipleChoices && status < http.StatusBadRequest {
 
@@ -101,7 +368,20 @@ func (b *delayedBody) WriteHeader(status int) {
 		return
 	}
 
-	// Write the error text and close the pipe in case of an error response.
+	// 416 Requested Range Not Satisfiable still has a real body (a short
+	// message) and a Content-Range: bytes */<size> header that
+	// http.ServeFile already set on this same Header() map. Let it
+	// through like a normal response instead of routing it through the
+	// generic error branch below, which would both synthesize its own
+	// body text in place of the real message and, since it closes the
+	// pipe from here, drop the real Write call that follows entirely.
+	if status == http.StatusRequestedRangeNotSatisfiable {
+		b.contentLength = -1
+		close(b.headerDone)
+		return
+	}
+
+	// Write the error text and close the pipe in case of any other error response.
 	if status >= http.StatusBadRequest {
 		close(b.headerDone)
 
@@ -114,9 +394,44 @@ func (b *delayedBody) WriteHeader(status int) {
 		return
 	}
 
-	// When Content-Encoding is set, no way to know when to close the
-	// pipe.
+	// Override the headers ServeFile derived from the precompressed
+	// sibling's path with the original file's content type and the
+	// encoding it was found under. Only reached once the branches above
+	// have ruled out a redirect/not-modified or error response, so this
+	// never touches a 304 or similar header-stripped response.
+	if b.contentType != "" {
+		b.response.Header.Set("Content-Type", b.contentType)
+	}
+	if b.contentEncoding != "" {
+		b.response.Header.Set("Content-Encoding", b.contentEncoding)
+	}
+
+	// 206 Partial Content: http.ServeFile already sets Content-Length to
+	// the served range's length, both for a single byte range and for
+	// multipart/byteranges, where it covers the whole multipart body.
+	// Taking that Content-Length here gates the pipe's EOF correctly in
+	// both cases, also for a range of a precompressed sibling, which the
+	// Content-Encoding branch below would gate by the sibling's full size.
+	if status == http.StatusPartialContent {
+		cl, err := strconv.Atoi(b.response.Header.Get("Content-Length"))
+		if err == nil {
+			b.contentLength = cl
+			close(b.headerDone)
+			return
+		}
+	}
+
+	// When Content-Encoding is set, there is normally no way to know
+	// when to close the pipe. For a precompressed sibling, though, the
+	// size on disk is already known, so it can still gate the EOF.
 	if b.response.Header.Get("Content-Encoding") != "" {
+		if b.compressedSize > 0 {
+			b.contentLength = b.compressedSize
+			b.response.Header.Set("Content-Length", strconv.Itoa(b.compressedSize))
+			close(b.headerDone)
+			return
+		}
+
 		b.contentLength = -1
 		close(b.headerDone)
 		return
@@ -151,19 +466,80 @@ func (b *delayedBody) Close() error {
 // request path prefix and a local directory path. When processing a
 // request, it clips the prefix from the request path, and appends the
 // rest of the path to the directory path. Then, it uses the resulting
-// path to serve static content from the file system.
+// path to serve static content from the file system. See CreateFilter
+// for the optional parameters controlling precompression and ETags.
 //
 // Name: "static".
-func NewStatic() filters.Spec { return &static{} }
+func NewStatic() filters.Spec { return &static{name: StaticName} }
+
+// Returns a filter Spec to serve static content from an arbitrary
+// http.FileSystem, such as http.Dir, the result of http.FS wrapping an
+// embed.FS, an in-memory virtual file system, or an adapter backed by an
+// object store. It shunts the route.
+//
+// Filter instances of this specification expect a single parameter: the
+// request path prefix. When processing a request, it clips the prefix
+// from the request path, and uses the rest of the path to serve static
+// content from fs through http.FileServer.
+//
+// Name: name.
+func NewStaticFS(name string, fs http.FileSystem) filters.Spec {
+	return &static{name: name, fs: fs}
+}
+
+// Returns a filter Spec like NewStatic, but for single-page apps that
+// do client-side routing: when the resolved path does not exist, or
+// resolves to a directory without its own index.html, it serves a
+// configured fallback file (by default "index.html" at the root of the
+// served directory) with 200 OK instead of 404. It shunts the route.
+//
+// Filter instances of this specification expect the same two
+// parameters as NewStatic (request path prefix and file system root),
+// plus an optional third parameter naming the fallback file relative
+// to the root, and the same further optional parameters CreateFilter
+// documents for NewStatic.
+//
+// Name: "staticSPA".
+func NewStaticSPA() filters.Spec { return &static{name: StaticSPAName, spa: true} }
 
-// "static"
-func (spec *static) Name() string { return StaticName }
+func (spec *static) Name() string { return spec.name }
 
-// Creates instances of the static filter. Expects two parameters: request path
-// prefix and file system root.
+// Creates instances of the static filter. A filter backed by an
+// http.FileSystem (see NewStaticFS) expects a single parameter, the
+// request path prefix. A filter backed by an OS directory (see
+// NewStatic) expects two parameters: request path prefix and file
+// system root, and accepts up to three further, optional parameters:
+//
+// - precompression control: false disables serving precompressed
+//   assets, a comma-separated string of extensions (e.g.
+//   ".html,.css,.js") restricts it to those extensions instead of the
+//   built-in default list.
+//
+// - etag mode: "weak" (mtime+size based) or "strong" (content hash
+//   based). Omitted or "" disables ETags.
+//
+// - etag hash: the hash algorithm used for a "strong" etag, one of
+//   "sha256" (the default), "sha1", "md5". Ignored for "weak" etags.
 func (spec *static) CreateFilter(config []interface{}) (filters.Filter, error) {
-	if len(config) != 2 {
-		return nil, fmt.Errorf("invalid number of args: %d, expected 1", len(config))
+	if spec.fs != nil {
+		if len(config) != 1 {
+			return nil, fmt.Errorf("invalid number of args: %d, expected 1", len(config))
+		}
+
+		webRoot, ok := config[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid parameter type, expected string for web root prefix")
+		}
+
+		return &static{name: spec.name, webRoot: webRoot, fs: spec.fs}, nil
+	}
+
+	minArgs, maxArgs := 2, 5
+	if spec.spa {
+		maxArgs++
+	}
+	if len(config) < minArgs || len(config) > maxArgs {
+		return nil, fmt.Errorf("invalid number of args: %d, expected %d to %d", len(config), minArgs, maxArgs)
 	}
 
 	webRoot, ok := config[0].(string)
@@ -176,7 +552,66 @@ func (spec *static) CreateFilter(config []interface{}) (filters.Filter, error) {
 		return nil, fmt.Errorf("invalid parameter type, expected string for path to root dir")
 	}
 
-	return &static{webRoot, root}, nil
+	rest := config[2:]
+
+	fallback := "index.html"
+	if spec.spa && len(rest) > 0 {
+		fallback, ok = rest[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid parameter type, expected string for fallback file")
+		}
+		rest = rest[1:]
+	}
+
+	compressExt := defaultCompressExtensions
+	if len(rest) >= 1 {
+		switch v := rest[0].(type) {
+		case bool:
+			if !v {
+				compressExt = nil
+			}
+		case string:
+			compressExt = strings.Split(v, ",")
+		default:
+			return nil, fmt.Errorf("invalid parameter type, expected bool or string for precompression control")
+		}
+	}
+
+	var etagMode string
+	if len(rest) >= 2 {
+		etagMode, ok = rest[1].(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid parameter type, expected string for etag mode")
+		}
+
+		if etagMode != "" && etagMode != "weak" && etagMode != "strong" {
+			return nil, fmt.Errorf("invalid etag mode: %s, expected \"weak\" or \"strong\"", etagMode)
+		}
+	}
+
+	var etagHash string
+	if len(rest) == 3 {
+		etagHash, ok = rest[2].(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid parameter type, expected string for etag hash")
+		}
+	}
+
+	f := &static{
+		name:        spec.name,
+		webRoot:     webRoot,
+		root:        root,
+		compressExt: compressExt,
+		etagMode:    etagMode,
+		etagHash:    etagHash,
+	}
+
+	if spec.spa {
+		f.spa = true
+		f.fallback = path.Join(root, fallback)
+	}
+
+	return f, nil
 }
 
 // Serves content from the file system and marks the request served.
@@ -189,7 +624,12 @@ func (f *static) Request(ctx filters.FilterContext) {
 		return
 	}
 
-	ctx.Serve(newDelayed(req, path.Join(f.root, p[len(f.webRoot):])))
+	if f.fs != nil {
+		ctx.Serve(newDelayedFS(req, f.fs, p[len(f.webRoot):]))
+		return
+	}
+
+	ctx.Serve(newDelayed(req, path.Join(f.root, p[len(f.webRoot):]), f.compressExt, f.etagMode, f.etagHash, f.fallback))
 }
 
 // Noop.
@@ -0,0 +1,95 @@
+// Copyright 2015 Zalando SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builtin
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewDelayedFS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "static-fs-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "hello.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatalf("failed to write fixture file: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "/assets/hello.txt", nil)
+	rsp := newDelayedFS(req, http.Dir(dir), "/hello.txt")
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want %d", rsp.StatusCode, http.StatusOK)
+	}
+
+	body, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		t.Fatalf("failed to read response body: %v", err)
+	}
+
+	if string(body) != "hello" {
+		t.Errorf("got body %q, want %q", body, "hello")
+	}
+}
+
+func TestNewDelayedFSNotFound(t *testing.T) {
+	dir, err := ioutil.TempDir("", "static-fs-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	req := httptest.NewRequest("GET", "/assets/missing.txt", nil)
+	rsp := newDelayedFS(req, http.Dir(dir), "/missing.txt")
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != http.StatusNotFound {
+		t.Errorf("got status %d, want %d", rsp.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestStaticFSCreateFilter(t *testing.T) {
+	spec := NewStaticFS(StaticName, http.Dir("."))
+
+	if _, err := spec.CreateFilter([]interface{}{"/assets/", "unexpected"}); err == nil {
+		t.Error("expected an error for a second argument on an FS-backed spec")
+	}
+
+	f, err := spec.CreateFilter([]interface{}{"/assets/"})
+	if err != nil {
+		t.Fatalf("CreateFilter failed: %v", err)
+	}
+
+	s, ok := f.(*static)
+	if !ok {
+		t.Fatalf("got filter of type %T, want *static", f)
+	}
+
+	if s.webRoot != "/assets/" {
+		t.Errorf("got webRoot %q, want %q", s.webRoot, "/assets/")
+	}
+
+	if s.fs == nil {
+		t.Error("expected fs to be carried over from the spec")
+	}
+}
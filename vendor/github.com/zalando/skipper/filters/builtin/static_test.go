@@ -0,0 +1,166 @@
+// Copyright 2015 Zalando SE
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builtin
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newTestDelayedBody() *delayedBody {
+	pr, pw := io.Pipe()
+	return &delayedBody{
+		request:    httptest.NewRequest("GET", "/foo", nil),
+		response:   &http.Response{Header: make(http.Header)},
+		reader:     pr,
+		writer:     pw,
+		headerDone: make(chan struct{}),
+	}
+}
+
+func TestDelayedBodyWriteHeaderNotModified(t *testing.T) {
+	b := newTestDelayedBody()
+	b.contentType = "text/css"
+	b.contentEncoding = "gzip"
+
+	go func() {
+		b.WriteHeader(http.StatusNotModified)
+	}()
+	<-b.headerDone
+
+	if ct := b.response.Header.Get("Content-Type"); ct != "" {
+		t.Errorf("Content-Type leaked onto a 304 response: %q", ct)
+	}
+
+	if ce := b.response.Header.Get("Content-Encoding"); ce != "" {
+		t.Errorf("Content-Encoding leaked onto a 304 response: %q", ce)
+	}
+}
+
+func TestDelayedBodyWriteHeaderOKSetsPrecompressedHeaders(t *testing.T) {
+	b := newTestDelayedBody()
+	b.contentType = "text/css"
+	b.contentEncoding = "gzip"
+	b.compressedSize = 42
+
+	go func() {
+		b.WriteHeader(http.StatusOK)
+	}()
+	<-b.headerDone
+
+	if ct := b.response.Header.Get("Content-Type"); ct != "text/css" {
+		t.Errorf("got Content-Type %q, want %q", ct, "text/css")
+	}
+
+	if ce := b.response.Header.Get("Content-Encoding"); ce != "gzip" {
+		t.Errorf("got Content-Encoding %q, want %q", ce, "gzip")
+	}
+
+	if b.contentLength != 42 {
+		t.Errorf("got contentLength %d, want 42", b.contentLength)
+	}
+}
+
+func TestDelayedBodyWriteHeaderPartialContent(t *testing.T) {
+	b := newTestDelayedBody()
+	b.response.Header.Set("Content-Length", "10")
+
+	go func() {
+		b.WriteHeader(http.StatusPartialContent)
+	}()
+	<-b.headerDone
+
+	if b.contentLength != 10 {
+		t.Errorf("got contentLength %d, want 10", b.contentLength)
+	}
+}
+
+func TestDelayedBodyWriteHeaderRangeNotSatisfiable(t *testing.T) {
+	b := newTestDelayedBody()
+	b.response.Header.Set("Content-Range", "bytes */100")
+
+	done := make(chan struct{})
+	go func() {
+		b.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		close(done)
+	}()
+	<-b.headerDone
+	<-done
+
+	if b.contentLength != -1 {
+		t.Errorf("got contentLength %d, want -1", b.contentLength)
+	}
+
+	if cr := b.response.Header.Get("Content-Range"); cr != "bytes */100" {
+		t.Errorf("Content-Range header was dropped: %q", cr)
+	}
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	for _, ti := range []struct {
+		msg            string
+		acceptEncoding string
+		token          string
+		want           bool
+	}{{
+		"plain match",
+		"gzip, deflate, br",
+		"gzip",
+		true,
+	}, {
+		"no match",
+		"deflate, br",
+		"gzip",
+		false,
+	}, {
+		"explicitly refused with q=0",
+		"gzip;q=0, br",
+		"gzip",
+		false,
+	}, {
+		"other token's q=0 doesn't affect this one",
+		"gzip;q=0, br",
+		"br",
+		true,
+	}, {
+		"nonzero q-value still accepts",
+		"gzip;q=0.5",
+		"gzip",
+		true,
+	}} {
+		t.Run(ti.msg, func(t *testing.T) {
+			if got := acceptsEncoding(ti.acceptEncoding, ti.token); got != ti.want {
+				t.Errorf("got %v, want %v", got, ti.want)
+			}
+		})
+	}
+}
+
+func TestLooksLikeAsset(t *testing.T) {
+	for _, ti := range []struct {
+		path string
+		want bool
+	}{
+		{"/app/settings", false},
+		{"/app/logo.png", true},
+		{"/app/", false},
+	} {
+		if got := looksLikeAsset(ti.path); got != ti.want {
+			t.Errorf("looksLikeAsset(%q): got %v, want %v", ti.path, got, ti.want)
+		}
+	}
+}